@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"encoding/json"
+	"encoding/xml"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -21,6 +28,7 @@ import (
 // TODO Understand whether it is ok to use package variables for using in internal functions
 var verbosity int = 0
 var workdir string = ""
+var numParallel int = 1
 
 //go:embed case.yaml
 var yamlConfig []byte
@@ -37,32 +45,42 @@ func print(msg string) {
 }
 
 type ScenarioItem struct {
-	// YAML-Defined data
-	Name         string            `yaml:"name"`
-	Case         string            `yaml:"case"`
-	GlobalEnv    map[string]string `yaml:"global_env"`
-	Env          map[string]string `yaml:"env"`
-	Workdir      string            `yaml:"workdir"`
-	Description  string            `yaml:"description"`
-	Script       string            `yaml:"script"`
-	Skip         bool              `yaml:"skip"`
-	Output       bool              `yaml:"output"`
-	SecretPhrase string            `yaml:"secret_phrase"`
-	Weight       int               `yaml:"weight"`
-	Log          string            `yaml:"log"`
-	Fatal        bool              `yaml:"fatal"`
-	Debug        string            `yaml:"debug"`
-	Before       []string          `yaml:"before"`
-	After        []string          `yaml:"after"`
+	// YAML/JSON-Defined data
+	Name         string            `yaml:"name" json:"name"`
+	Case         string            `yaml:"case" json:"case"`
+	GlobalEnv    map[string]string `yaml:"global_env" json:"global_env"`
+	Env          map[string]string `yaml:"env" json:"env"`
+	Workdir      string            `yaml:"workdir" json:"workdir"`
+	Description  string            `yaml:"description" json:"description"`
+	Script       string            `yaml:"script" json:"script"`
+	Skip         bool              `yaml:"skip" json:"skip"`
+	Output       bool              `yaml:"output" json:"output"`
+	SecretPhrase string            `yaml:"secret_phrase" json:"secret_phrase"`
+	Weight       int               `yaml:"weight" json:"weight"`
+	Log          string            `yaml:"log" json:"log"`
+	Fatal        bool              `yaml:"fatal" json:"fatal"`
+	Debug        string            `yaml:"debug" json:"debug"`
+	Before       []string          `yaml:"before" json:"before"`
+	After        []string          `yaml:"after" json:"after"`
+	Needs        []string          `yaml:"needs" json:"needs"`
+	Timeout      string            `yaml:"timeout" json:"timeout"`
+	Retries      int               `yaml:"retries" json:"retries"`
+	RetryBackoff string            `yaml:"retry_backoff" json:"retry_backoff"`
+	Flaky        bool              `yaml:"flaky" json:"flaky"`
+	Benchmark    bool              `yaml:"benchmark" json:"benchmark"`
 
 	// Runtime data
-	Status   string
-	Result   error
-	Stdout   string
-	Duration string
-
-	canShow bool
-	canRun  bool
+	Status         string
+	Result         error
+	Stdout         string
+	Duration       string
+	Attempts       int
+	AttemptStdouts []string
+	WasFlaky       bool
+
+	canShow     bool
+	canRun      bool
+	envFileVars map[string]string
 }
 
 func (s *ScenarioItem) IsSuccessful() bool {
@@ -88,23 +106,47 @@ func (s *ScenarioItem) RunBash() ([]byte, error) {
 
 		tmpFile, _ := ioutil.TempFile(tmpDir, "tmp.*")
 
+		scriptBody := s.Script
+		if s.Benchmark {
+			scriptBody = benchmarkTimerHelpers + "\n" + scriptBody
+		}
+
 		T := struct {
 			Script string
 		}{
-			Script: s.Script,
+			Script: scriptBody,
 		}
 
 		tmpl, _ := template.New("bash-script").Parse(string(bash.BashScript))
 		tmpl.Execute(tmpFile, T)
 
-		script := exec.Command("/bin/bash", tmpFile.Name())
-		script.Dir = workdir
+		ctx := context.Background()
+		if s.Timeout != "" {
+			if d, parseErr := time.ParseDuration(s.Timeout); parseErr == nil {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d)
+				defer cancel()
+			}
+		}
+
+		script := exec.CommandContext(ctx, "/bin/bash", tmpFile.Name())
+		script.Dir = s.Workdir
 		script.Env = os.Environ()
+		for key, value := range s.envFileVars {
+			script.Env = append(script.Env,
+				fmt.Sprintf("%s=%s", key, value),
+			)
+		}
 		for key, value := range s.GlobalEnv {
 			script.Env = append(script.Env,
 				fmt.Sprintf("%s=%s", key, value),
 			)
 		}
+		for key, value := range s.Env {
+			script.Env = append(script.Env,
+				fmt.Sprintf("%s=%s", key, value),
+			)
+		}
 
 		stdout, err = script.CombinedOutput()
 		s.Stdout = strings.TrimSpace(string(stdout))
@@ -122,8 +164,10 @@ func (s *ScenarioItem) RunBash() ([]byte, error) {
 }
 
 type suitConfig struct {
-	Name  string         `yaml:"name"`
-	Cases []ScenarioItem `yaml:"cases"`
+	Name     string         `yaml:"name" json:"name"`
+	Cases    []ScenarioItem `yaml:"cases" json:"cases"`
+	Include  []string       `yaml:"include" json:"include"`
+	EnvFiles []string       `yaml:"env_files" json:"env_files"`
 
 	startTime time.Time
 	endTime   time.Time
@@ -131,6 +175,7 @@ type suitConfig struct {
 	all         int
 	successfull int
 	failed      int
+	flaky       int
 	score       float64
 	duration    string
 }
@@ -150,44 +195,68 @@ func (c *suitConfig) getScenarioIds() []int {
 	return result
 }
 
+// getScenarioCount returns the number of pass/fail scenarios to be shown,
+// excluding benchmark cases, which are reported separately and not scored.
 func (c *suitConfig) getScenarioCount() int {
 	result := 0
 	for _, i := range c.getScenarioIds() {
-		if c.Cases[i].CanShow() {
+		if c.Cases[i].CanShow() && !c.Cases[i].Benchmark {
 			result++
 		}
 	}
 	return result
 }
 
-func (c *suitConfig) getIdByName(name string) int {
-	for id, item := range c.Cases {
-		if item.Name == name {
-			return id
-		}
+// applyFilter narrows which cases are shown/scored to those selected by
+// positional case names and/or -run, with -skip excluding from that set
+// afterwards. It only touches canShow/canRun, so Before/After dependency
+// lookups in buildNeedsGraph (which resolves names over all of c.Cases) keep
+// working for excluded cases even though they no longer appear in
+// getScenarioIds.
+func (c *suitConfig) applyFilter(names []string, runPattern *regexp.Regexp, skipPattern *regexp.Regexp) {
+	if len(names) == 0 && runPattern == nil && skipPattern == nil {
+		return
 	}
-	return -1
-}
 
-func (c *suitConfig) printHeader() {
-	scenariosCount := c.getScenarioCount()
+	for i := range c.Cases {
+		item := &c.Cases[i]
+		if !item.CanShow() {
+			continue
+		}
 
-	c.startTime = time.Now()
+		matched := true
+		if len(names) > 0 {
+			matched = false
+			for _, name := range names {
+				if item.Case == name {
+					matched = true
+					break
+				}
+			}
+		}
 
-	if scenariosCount > 1 {
-		log.Printf("[ %s ], 1..%d tests\n", c.Name, scenariosCount)
-		return
-	}
+		if matched && runPattern != nil {
+			matched = runPattern.MatchString(item.Case)
+		}
 
-	if scenariosCount == 1 {
-		log.Printf("[ %s ], 1 test\n", c.Name)
-		return
+		if matched && skipPattern != nil && skipPattern.MatchString(item.Case) {
+			matched = false
+		}
+
+		if !matched {
+			item.canShow = false
+			item.canRun = false
+		}
 	}
+}
 
-	if scenariosCount == 0 {
-		log.Printf("[ %s ], no tests to run\n", c.Name)
-		return
+func (c *suitConfig) getIdByName(name string) int {
+	for id, item := range c.Cases {
+		if item.Name == name {
+			return id
+		}
 	}
+	return -1
 }
 
 func (c *suitConfig) signOff() {
@@ -196,15 +265,19 @@ func (c *suitConfig) signOff() {
 	sum := 0
 	max := 0
 	failed := 0
+	flaky := 0
 	all := 0
 
 	for _, i := range c.getScenarioIds() {
 		item := c.Cases[i]
-		if item.CanShow() {
+		if item.CanShow() && !item.Benchmark {
 			all++
 			max += item.Weight
 			if item.IsSuccessful() {
 				sum += item.Weight
+				if item.WasFlaky {
+					flaky++
+				}
 			} else {
 				failed++
 			}
@@ -213,102 +286,811 @@ func (c *suitConfig) signOff() {
 
 	c.successfull = all - failed
 	c.failed = failed
+	c.flaky = flaky
 	c.all = all
 	c.score = 100 * float64(sum) / float64(max)
 	c.duration = duration(c.startTime, c.endTime)
 }
 
-func (c *suitConfig) printSummary() {
+// Reporter decouples "what happened" from "how it's surfaced". Exactly one
+// is selected per run via -format and driven by main(): OnStart once the
+// scenario set is known, OnCase for each shown case in declaration order,
+// OnFinish once signOff() has computed the summary.
+type Reporter interface {
+	OnStart(c *suitConfig)
+	OnCase(c *suitConfig, id int, position int)
+	OnBenchmark(c *suitConfig, id int, result BenchResult)
+	OnFinish(c *suitConfig)
+}
+
+func newReporter(format string) Reporter {
+	switch format {
+	case "json":
+		return &jsonReporter{}
+	case "junit":
+		return &junitReporter{}
+	case "tap":
+		return &tapReporter{}
+	default:
+		return &humanReporter{}
+	}
+}
+
+// humanReporter reproduces the original ANSI console output.
+type humanReporter struct {
+	benchHeaderPrinted bool
+}
+
+func (r *humanReporter) OnStart(c *suitConfig) {
+	scenariosCount := c.getScenarioCount()
+
+	c.startTime = time.Now()
+
+	if scenariosCount > 1 {
+		log.Printf("[ %s ], 1..%d tests\n", c.Name, scenariosCount)
+	} else if scenariosCount == 1 {
+		log.Printf("[ %s ], 1 test\n", c.Name)
+	} else {
+		log.Printf("[ %s ], no tests to run\n", c.Name)
+		return
+	}
+
+	print("-----------------------------------------------------------------------------------")
+}
+
+func (r *humanReporter) OnCase(c *suitConfig, id int, position int) {
+	testCase := c.Cases[id]
+
+	if testCase.IsSuccessful() {
+		print(fmt.Sprintf("\033[32m✓ %2d  %s, %s, secret phrase: %s\033[0m", position, testCase.Case, testCase.Duration, testCase.SecretPhrase))
+	} else {
+		print(fmt.Sprintf("\033[31m✗ %2d  %s, %s\033[0m", position, testCase.Case, testCase.Duration))
+	}
+
+	if (verbosity > 1 && testCase.IsFailed()) || (verbosity > 2) {
+		for _, name := range testCase.Before {
+			log.Printf("(run: %s)\n", name)
+			log.Printf(">> script:\n%s\n", strings.TrimSpace(c.Cases[c.getIdByName(name)].Script))
+			log.Printf(">> stdout:\n%s\n", c.Cases[c.getIdByName(name)].Stdout)
+			if c.Cases[c.getIdByName(name)].Result == nil {
+				log.Printf(">> exit status 0 (successfull)")
+			} else {
+				log.Printf(">> %s (failure)", c.Cases[c.getIdByName(name)].Result)
+			}
+			log.Printf("---")
+		}
+
+		log.Printf("~~~~~")
+		if len(testCase.AttemptStdouts) > 1 {
+			for attempt, stdout := range testCase.AttemptStdouts {
+				log.Printf(">> attempt %d stdout:\n%s", attempt+1, strings.TrimSpace(stdout))
+			}
+		} else {
+			log.Printf(">> stdout:\n%s", strings.TrimSpace(testCase.Stdout))
+		}
+		if testCase.Result == nil {
+			log.Printf(">> exit status 0 (successfull)")
+		} else {
+			log.Printf(">> %s (failure)", testCase.Result)
+		}
+		log.Printf("~~~~~")
+
+		for _, name := range testCase.After {
+			log.Printf("(run: %s)\n", name)
+			log.Printf(">> script:\n%s\n", strings.TrimSpace(c.Cases[c.getIdByName(name)].Script))
+			log.Printf(">> stdout:\n%s\n", c.Cases[c.getIdByName(name)].Stdout)
+			if c.Cases[c.getIdByName(name)].Result == nil {
+				log.Printf(">> exit status 0 (successfull)")
+			} else {
+				log.Printf(">> %s (failure)", c.Cases[c.getIdByName(name)].Result)
+			}
+			log.Printf("---")
+		}
+	}
+}
+
+func (r *humanReporter) OnFinish(c *suitConfig) {
 	if c.all > 0 {
+		print("-----------------------------------------------------------------------------------")
+		flakyNote := ""
+		if c.flaky > 0 {
+			flakyNote = fmt.Sprintf(", %d flaky", c.flaky)
+		}
 		if c.failed > 0 {
-			print(fmt.Sprintf("%d (of %d) tests passed, \033[31m%d tests failed,\033[0m rated as %.2f%%, spent %s", c.successfull, c.all, c.failed, c.score, c.duration))
+			print(fmt.Sprintf("%d (of %d) tests passed%s, \033[31m%d tests failed,\033[0m rated as %.2f%%, spent %s", c.successfull, c.all, flakyNote, c.failed, c.score, c.duration))
 		} else {
-			print(fmt.Sprintf("\033[32m%d (of %d) tests passed, %d tests failed, rated as %.2f%%, spent %s\033[0m", c.successfull, c.all, c.failed, c.score, c.duration))
+			print(fmt.Sprintf("\033[32m%d (of %d) tests passed%s, %d tests failed, rated as %.2f%%, spent %s\033[0m", c.successfull, c.all, flakyNote, c.failed, c.score, c.duration))
 		}
 	}
 }
 
-func (c *suitConfig) printTestStatus(id int, asId ...int) {
+func (r *humanReporter) OnBenchmark(c *suitConfig, id int, result BenchResult) {
+	if !r.benchHeaderPrinted {
+		print("-----------------------------------------------------------------------------------")
+		print("Benchmarks:")
+		r.benchHeaderPrinted = true
+	}
+
 	testCase := c.Cases[id]
-	i := id
-	if len(asId) > 0 {
-		i = asId[0]
-	}
-
-	for _, j := range c.getScenarioIds() {
-		if j == id {
-			if testCase.CanShow() {
-				if testCase.IsSuccessful() {
-					print(fmt.Sprintf("\033[32m✓ %2d  %s, %s, secret phrase: %s\033[0m", i, testCase.Case, testCase.Duration, testCase.SecretPhrase))
-				} else {
-					print(fmt.Sprintf("\033[31m✗ %2d  %s, %s\033[0m", i, testCase.Case, testCase.Duration))
-				}
+	bytesNote := ""
+	if result.HasBytesPerOp {
+		bytesNote = fmt.Sprintf(", %d B/op", result.BytesPerOp)
+	}
+	print(fmt.Sprintf("  %-24s %6d iters  min=%s max=%s mean=%s stddev=%s%s",
+		testCase.Case, result.Iterations, result.Min, result.Max, result.Mean, result.StdDev, bytesNote))
+}
 
-				if (verbosity > 1 && testCase.IsFailed()) || (verbosity > 2) {
-					for _, name := range testCase.Before {
-						log.Printf("(run: %s)\n", name)
-						log.Printf(">> script:\n%s\n", strings.TrimSpace(c.Cases[c.getIdByName(name)].Script))
-						log.Printf(">> stdout:\n%s\n", c.Cases[c.getIdByName(name)].Stdout)
-						if c.Cases[c.getIdByName(name)].Result == nil {
-							log.Printf(">> exit status 0 (successfull)")
-						} else {
-							log.Printf(">> %s (failure)", c.Cases[c.getIdByName(name)].Result)
-						}
-						log.Printf("---")
-					}
-
-					log.Printf("~~~~~")
-					log.Printf(">> stdout:\n%s", strings.TrimSpace(testCase.Stdout))
-					if testCase.Result == nil {
-						log.Printf(">> exit status 0 (successfull)")
-					} else {
-						log.Printf(">> %s (failure)", testCase.Result)
-					}
-					log.Printf("~~~~~")
-
-					for _, name := range testCase.After {
-						log.Printf("(run: %s)\n", name)
-						log.Printf(">> script:\n%s\n", strings.TrimSpace(c.Cases[c.getIdByName(name)].Script))
-						log.Printf(">> stdout:\n%s\n", c.Cases[c.getIdByName(name)].Stdout)
-						if c.Cases[c.getIdByName(name)].Result == nil {
-							log.Printf(">> exit status 0 (successfull)")
-						} else {
-							log.Printf(">> %s (failure)", c.Cases[c.getIdByName(name)].Result)
-						}
-						log.Printf("---")
-					}
-				}
-			}
-			return
+// tapReporter emits the Test Anything Protocol format (`1..N`, `ok N - name`).
+type tapReporter struct{}
+
+func (r *tapReporter) OnStart(c *suitConfig) {
+	c.startTime = time.Now()
+	fmt.Printf("1..%d\n", c.getScenarioCount())
+}
+
+func (r *tapReporter) OnCase(c *suitConfig, id int, position int) {
+	testCase := c.Cases[id]
+	if testCase.IsSuccessful() {
+		fmt.Printf("ok %d - %s\n", position, testCase.Case)
+	} else {
+		fmt.Printf("not ok %d - %s\n", position, testCase.Case)
+	}
+}
+
+func (r *tapReporter) OnBenchmark(c *suitConfig, id int, result BenchResult) {
+	testCase := c.Cases[id]
+	fmt.Printf("# benchmark %s: %d iters, mean=%s\n", testCase.Case, result.Iterations, result.Mean)
+}
+
+func (r *tapReporter) OnFinish(c *suitConfig) {
+	fmt.Printf("# %d (of %d) passed, %d flaky, rated as %.2f%%, spent %s\n", c.successfull, c.all, c.flaky, c.score, c.duration)
+}
+
+// jsonReporter streams one object per case as it is reported, followed by a
+// single summary object carrying the overall score. Intended for CI systems
+// that grade submissions programmatically.
+type jsonCaseRecord struct {
+	Name       string `json:"name"`
+	Case       string `json:"case"`
+	Status     string `json:"status"`
+	Weight     int    `json:"weight"`
+	DurationMs int64  `json:"duration_ms"`
+	Stdout     string `json:"stdout"`
+	ExitError  string `json:"exit_error,omitempty"`
+	Attempts   int    `json:"attempts"`
+	Flaky      bool   `json:"flaky"`
+}
+
+type jsonBenchmarkRecord struct {
+	Case          string `json:"case"`
+	Iterations    int    `json:"iterations"`
+	MinNs         int64  `json:"min_ns"`
+	MaxNs         int64  `json:"max_ns"`
+	MeanNs        int64  `json:"mean_ns"`
+	StdDevNs      int64  `json:"stddev_ns"`
+	BytesPerOp    int64  `json:"bytes_per_op,omitempty"`
+	HasBytesPerOp bool   `json:"has_bytes_per_op"`
+}
+
+type jsonSummaryRecord struct {
+	Score       float64 `json:"score"`
+	All         int     `json:"all"`
+	Successfull int     `json:"successfull"`
+	Failed      int     `json:"failed"`
+	Flaky       int     `json:"flaky"`
+	Duration    string  `json:"duration"`
+}
+
+type jsonReporter struct{}
+
+func (r *jsonReporter) OnStart(c *suitConfig) {
+	c.startTime = time.Now()
+}
+
+func (r *jsonReporter) OnCase(c *suitConfig, id int, position int) {
+	testCase := c.Cases[id]
+
+	record := jsonCaseRecord{
+		Name:       testCase.Name,
+		Case:       testCase.Case,
+		Status:     testCase.Status,
+		Weight:     testCase.Weight,
+		DurationMs: durationMs(testCase.Duration),
+		Stdout:     testCase.Stdout,
+		Attempts:   testCase.Attempts,
+		Flaky:      testCase.WasFlaky,
+	}
+	if testCase.Result != nil {
+		record.ExitError = testCase.Result.Error()
+	}
+
+	out, _ := json.Marshal(record)
+	fmt.Println(string(out))
+}
+
+func (r *jsonReporter) OnBenchmark(c *suitConfig, id int, result BenchResult) {
+	testCase := c.Cases[id]
+
+	out, _ := json.Marshal(jsonBenchmarkRecord{
+		Case:          testCase.Case,
+		Iterations:    result.Iterations,
+		MinNs:         result.Min.Nanoseconds(),
+		MaxNs:         result.Max.Nanoseconds(),
+		MeanNs:        result.Mean.Nanoseconds(),
+		StdDevNs:      result.StdDev.Nanoseconds(),
+		BytesPerOp:    result.BytesPerOp,
+		HasBytesPerOp: result.HasBytesPerOp,
+	})
+	fmt.Println(string(out))
+}
+
+func (r *jsonReporter) OnFinish(c *suitConfig) {
+	out, _ := json.Marshal(jsonSummaryRecord{
+		Score:       c.score,
+		All:         c.all,
+		Successfull: c.successfull,
+		Failed:      c.failed,
+		Flaky:       c.flaky,
+		Duration:    c.duration,
+	})
+	fmt.Println(string(out))
+}
+
+// junitReporter emits a <testsuite> document matching the schema Jenkins,
+// GitLab and GitHub Actions ingest.
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+type junitTestcase struct {
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Attempts  int           `xml:"attempts,attr,omitempty"`
+	Flaky     bool          `xml:"flaky,attr,omitempty"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitTestsuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestcase `xml:"testcase"`
+}
+
+type junitReporter struct {
+	suite junitTestsuite
+}
+
+func (r *junitReporter) OnStart(c *suitConfig) {
+	c.startTime = time.Now()
+	r.suite.Name = c.Name
+}
+
+func (r *junitReporter) OnCase(c *suitConfig, id int, position int) {
+	testCase := c.Cases[id]
+
+	tc := junitTestcase{
+		Name:      testCase.Case,
+		Time:      fmt.Sprintf("%.3f", float64(durationMs(testCase.Duration))/1000),
+		SystemOut: testCase.Stdout,
+		Attempts:  testCase.Attempts,
+		Flaky:     testCase.WasFlaky,
+	}
+	if !testCase.IsSuccessful() {
+		message := testCase.Status
+		if testCase.Result != nil {
+			message = testCase.Result.Error()
 		}
+		tc.Failure = &junitFailure{Message: message, Body: testCase.Stdout}
 	}
+
+	r.suite.Tests++
+	if !testCase.IsSuccessful() {
+		r.suite.Failures++
+	}
+	r.suite.Cases = append(r.suite.Cases, tc)
+}
+
+// OnBenchmark is a no-op: JUnit's schema has no benchmark concept, and CI
+// systems ingesting it wouldn't know what to do with one.
+func (r *junitReporter) OnBenchmark(c *suitConfig, id int, result BenchResult) {}
+
+func (r *junitReporter) OnFinish(c *suitConfig) {
+	r.suite.Time = fmt.Sprintf("%.3f", float64(durationMs(c.duration))/1000)
+
+	out, _ := xml.MarshalIndent(r.suite, "", "  ")
+	fmt.Println(xml.Header + string(out))
 }
 
+// durationMs parses a Go-formatted duration string (as produced by
+// duration()) into whole milliseconds, tolerating a zero value.
+func durationMs(d string) int64 {
+	if d == "" {
+		return 0
+	}
+	parsed, err := time.ParseDuration(d)
+	if err != nil {
+		return 0
+	}
+	return parsed.Milliseconds()
+}
+
+// exec runs item's own script. Before/After helpers are not run inline here:
+// buildNeedsGraph folds them into the dependency graph as nodes in their own
+// right, so the pool schedules each one exactly once, synchronized the same
+// way as any other case, instead of every dependent case re-running (and
+// racing on) a shared helper's ScenarioItem.
 func (c *suitConfig) exec(item int) {
 	testCase := &c.Cases[item]
 	if testCase.Script != "" {
 		taskStartTime := time.Now()
+		execWithRetries(testCase)
+		testCase.Duration = duration(taskStartTime, time.Now())
+	}
+}
 
-		for _, name := range testCase.Before {
-			c.Cases[c.getIdByName(name)].RunBash()
+// execWithRetries runs testCase up to Retries+1 times, waiting
+// retry_backoff (doubled on each successive attempt) between failures. A
+// case that only succeeds after a retry is marked WasFlaky when flaky: true.
+func execWithRetries(testCase *ScenarioItem) {
+	var backoff time.Duration
+	if testCase.RetryBackoff != "" {
+		if d, err := time.ParseDuration(testCase.RetryBackoff); err == nil {
+			backoff = d
 		}
+	}
 
+	attempts := testCase.Retries + 1
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; attempt <= attempts; attempt++ {
 		testCase.RunBash()
+		testCase.Attempts = attempt
+		testCase.AttemptStdouts = append(testCase.AttemptStdouts, testCase.Stdout)
 
-		for _, name := range testCase.After {
-			c.Cases[c.getIdByName(name)].RunBash()
+		if testCase.IsSuccessful() {
+			if attempt > 1 && testCase.Flaky {
+				testCase.WasFlaky = true
+			}
+			return
 		}
 
-		testCase.Duration = duration(taskStartTime, time.Now())
+		if attempt < attempts && backoff > 0 {
+			time.Sleep(backoff * time.Duration(int64(1)<<uint(attempt-1)))
+		}
+	}
+}
+
+// benchmarkTimerHelpers is prepended to a benchmark case's script, mirroring
+// gocheck's StartTimer/StopTimer: calling checkup_start_timer resets the
+// measured window (excluding setup cost), and checkup_stop_timer closes it.
+// Both print a marker line the runner scrapes out of stdout.
+const benchmarkTimerHelpers = `
+checkup_start_timer() { echo "CHECKUP_BENCH_START=$(date +%s%N)"; }
+checkup_stop_timer() { echo "CHECKUP_BENCH_STOP=$(date +%s%N)"; }
+`
+
+var benchStartPattern = regexp.MustCompile(`CHECKUP_BENCH_START=(\d+)`)
+var benchStopPattern = regexp.MustCompile(`CHECKUP_BENCH_STOP=(\d+)`)
+var benchBytesPattern = regexp.MustCompile(`CHECKUP_BYTES=(\d+)`)
+
+// measuredDuration prefers the window between the last checkup_start_timer
+// and checkup_stop_timer marks in stdout, falling back to full wall time.
+func measuredDuration(stdout string, wall time.Duration) time.Duration {
+	startMatch := benchStartPattern.FindAllStringSubmatch(stdout, -1)
+	stopMatch := benchStopPattern.FindAllStringSubmatch(stdout, -1)
+	if len(startMatch) == 0 || len(stopMatch) == 0 {
+		return wall
+	}
+
+	startNs, err1 := strconv.ParseInt(startMatch[len(startMatch)-1][1], 10, 64)
+	stopNs, err2 := strconv.ParseInt(stopMatch[len(stopMatch)-1][1], 10, 64)
+	if err1 != nil || err2 != nil || stopNs < startNs {
+		return wall
+	}
+
+	return time.Duration(stopNs - startNs)
+}
+
+// bytesPerOp reads the value of the last `CHECKUP_BYTES=<n>` mark in stdout,
+// if any. The mark is matched wherever it appears, not only on the final line.
+func bytesPerOp(stdout string) (int64, bool) {
+	matches := benchBytesPattern.FindAllStringSubmatch(stdout, -1)
+	if len(matches) == 0 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(matches[len(matches)-1][1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// BenchResult is the per-case outcome of a benchmark run: iteration count
+// plus min/max/mean/stddev of the per-iteration time (the timer-marked window
+// when the script uses checkup_start_timer/checkup_stop_timer, otherwise wall
+// time), and an optional bytes-per-op figure reported by the script itself.
+type BenchResult struct {
+	Iterations    int
+	Min           time.Duration
+	Max           time.Duration
+	Mean          time.Duration
+	StdDev        time.Duration
+	BytesPerOp    int64
+	HasBytesPerOp bool
+}
+
+func summarizeBenchResult(durations []time.Duration, bytes int64, hasBytes bool) BenchResult {
+	result := BenchResult{Iterations: len(durations), BytesPerOp: bytes, HasBytesPerOp: hasBytes}
+	if len(durations) == 0 {
+		return result
+	}
+
+	var sum time.Duration
+	result.Min = durations[0]
+	result.Max = durations[0]
+	for _, d := range durations {
+		sum += d
+		if d < result.Min {
+			result.Min = d
+		}
+		if d > result.Max {
+			result.Max = d
+		}
+	}
+	result.Mean = sum / time.Duration(len(durations))
+
+	var variance float64
+	for _, d := range durations {
+		delta := float64(d - result.Mean)
+		variance += delta * delta
+	}
+	variance /= float64(len(durations))
+	result.StdDev = time.Duration(math.Sqrt(variance))
+
+	return result
+}
+
+// runBenchmark executes item's script repeatedly, either for benchTime or
+// for a fixed benchCount iterations when benchCount > 0.
+func runBenchmark(item *ScenarioItem, benchTime time.Duration, benchCount int) BenchResult {
+	var durations []time.Duration
+	var bytes int64
+	hasBytes := false
+
+	deadline := time.Now().Add(benchTime)
+	for i := 0; benchCount > 0 && i < benchCount || benchCount <= 0 && time.Now().Before(deadline); i++ {
+		start := time.Now()
+		stdout, _ := item.RunBash()
+		wall := time.Since(start)
+
+		durations = append(durations, measuredDuration(string(stdout), wall))
+		if b, ok := bytesPerOp(string(stdout)); ok {
+			bytes = b
+			hasBytes = true
+		}
+	}
+
+	return summarizeBenchResult(durations, bytes, hasBytes)
+}
+
+// buildNeedsGraph maps each scenario id to the ids of the scenarios that
+// must finish before it may start: its declared `needs:`, plus its `before:`
+// helpers. An `after:` helper is the mirror image: it depends on the case
+// that names it, rather than the other way round. Before/After helpers
+// referenced by name that aren't already in ids (the common case, since a
+// pure helper has no `case:` of its own) are folded in as extra nodes, so
+// the pool runs and synchronizes each one exactly once, however many cases
+// share it, instead of it being re-run inline by every dependent. A `needs:`
+// target outside ids is folded in the same way. The returned node list is
+// ids plus any such folded-in helpers and needs targets.
+func (c *suitConfig) buildNeedsGraph(ids []int) (map[int][]int, []int) {
+	nameToId := map[string]int{}
+	for id, item := range c.Cases {
+		if item.Name != "" {
+			nameToId[item.Name] = id
+		}
+	}
+
+	inSet := map[int]bool{}
+	nodes := append([]int{}, ids...)
+	for _, id := range ids {
+		inSet[id] = true
+	}
+	include := func(id int) {
+		if !inSet[id] {
+			inSet[id] = true
+			nodes = append(nodes, id)
+		}
+	}
+
+	deps := map[int][]int{}
+	for i := 0; i < len(nodes); i++ {
+		id := nodes[i]
+
+		for _, need := range c.Cases[id].Needs {
+			if depId, ok := nameToId[need]; ok {
+				deps[id] = append(deps[id], depId)
+				include(depId)
+			}
+		}
+		for _, name := range c.Cases[id].Before {
+			if depId, ok := nameToId[name]; ok {
+				deps[id] = append(deps[id], depId)
+				include(depId)
+			}
+		}
+		for _, name := range c.Cases[id].After {
+			if depId, ok := nameToId[name]; ok {
+				deps[depId] = append(deps[depId], id)
+				include(depId)
+			}
+		}
+	}
+
+	return deps, nodes
+}
+
+// cyclicDependency reports whether deps, restricted to nodes, contains a
+// cycle, via a Kahn's-algorithm pass: if some nodes never reach an in-degree
+// of zero, they're part of (or depend on) a cycle.
+func cyclicDependency(nodes []int, deps map[int][]int) bool {
+	indegree := make(map[int]int, len(nodes))
+	dependents := map[int][]int{}
+	for _, id := range nodes {
+		indegree[id] = len(deps[id])
+	}
+	for id, ds := range deps {
+		for _, d := range ds {
+			dependents[d] = append(dependents[d], id)
+		}
+	}
+
+	queue := []int{}
+	for _, id := range nodes {
+		if indegree[id] == 0 {
+			queue = append(queue, id)
+		}
+	}
+
+	visited := 0
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, dep := range dependents[id] {
+			indegree[dep]--
+			if indegree[dep] == 0 {
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	return visited != len(nodes)
+}
+
+// runScheduled executes the given scenario ids (plus any before/after
+// helpers and needs targets buildNeedsGraph folds in) through a bounded
+// worker pool, releasing
+// a node as soon as everything it depends on has finished. Printing is left
+// to the caller so output can stay ordered by id.
+func (c *suitConfig) runScheduled(ids []int) {
+	deps, nodes := c.buildNeedsGraph(ids)
+
+	if cyclicDependency(nodes, deps) {
+		log.Fatal("scenario dependency graph has a cycle: check needs/before/after for a loop")
+	}
+
+	remaining := make(map[int]int, len(nodes))
+	dependents := make(map[int][]int, len(nodes))
+	for _, id := range nodes {
+		remaining[id] = len(deps[id])
+	}
+	for id, ds := range deps {
+		for _, d := range ds {
+			dependents[d] = append(dependents[d], id)
+		}
+	}
+
+	workers := numParallel
+	if workers < 1 {
+		workers = 1
+	}
+
+	var mu sync.Mutex
+	ready := make(chan int, len(nodes))
+	completed := make(chan int, len(nodes))
+	sem := make(chan struct{}, workers)
+
+	for _, id := range nodes {
+		if remaining[id] == 0 {
+			ready <- id
+		}
+	}
+
+	for done := 0; done < len(nodes); {
+		select {
+		case id := <-ready:
+			sem <- struct{}{}
+			go func(id int) {
+				c.exec(id)
+				<-sem
+				completed <- id
+			}(id)
+		case id := <-completed:
+			done++
+			mu.Lock()
+			for _, dep := range dependents[id] {
+				remaining[dep]--
+				if remaining[dep] == 0 {
+					ready <- dep
+				}
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// unmarshalSuite parses config according to filename's extension (.json vs
+// YAML) so the same suitConfig shape can come from either source.
+func unmarshalSuite(filename string, config []byte, t *suitConfig) error {
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		return json.Unmarshal(config, t)
+	}
+	return yaml.Unmarshal(config, t)
+}
+
+// resolveIncludes recursively merges the `cases:` of every file named in
+// t.Include into t, resolving relative paths against filename's directory.
+func resolveIncludes(t *suitConfig, filename string) {
+	includes := t.Include
+	t.Include = nil
+
+	dir := filepath.Dir(filename)
+	for _, include := range includes {
+		includePath := include
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(dir, includePath)
+		}
+
+		data, err := ioutil.ReadFile(includePath)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Cannot read included configuration %s: %s", includePath, err))
+		}
+
+		var sub suitConfig
+		if err := unmarshalSuite(includePath, data, &sub); err != nil {
+			log.Fatal(fmt.Sprintf("Cannot recognize configuration structure in %s: %s", includePath, err))
+		}
+
+		resolveIncludes(&sub, includePath)
+		t.Cases = append(t.Cases, sub.Cases...)
+	}
+}
+
+// validateDependencies checks that every Before/After name referenced
+// anywhere in the merged case set resolves to a case in that same set.
+func (c *suitConfig) validateDependencies() error {
+	names := map[string]bool{}
+	for _, item := range c.Cases {
+		if item.Name != "" {
+			names[item.Name] = true
+		}
+	}
+
+	for _, item := range c.Cases {
+		for _, dep := range item.Before {
+			if !names[dep] {
+				return fmt.Errorf("case %q references unknown before dependency %q", item.Case, dep)
+			}
+		}
+		for _, dep := range item.After {
+			if !names[dep] {
+				return fmt.Errorf("case %q references unknown after dependency %q", item.Case, dep)
+			}
+		}
+	}
+	return nil
+}
+
+// parseEnvFile reads a dotenv-style `KEY=VALUE` file, skipping blank lines
+// and lines starting with `#`.
+func parseEnvFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+		result[key] = value
 	}
+	return result, nil
 }
 
-func (t *suitConfig) getConf(config []byte) *suitConfig {
-	err := yaml.Unmarshal(config, t)
+// loadEnvFiles resolves and merges every suite-level env_files entry,
+// relative paths against suiteDir, later files winning on key conflict.
+func loadEnvFiles(paths []string, suiteDir string) (map[string]string, error) {
+	merged := map[string]string{}
+	for _, p := range paths {
+		path := p
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(suiteDir, path)
+		}
+
+		vars, err := parseEnvFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading env file %s: %w", path, err)
+		}
+		for k, v := range vars {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// mergedEnv layers, from lowest to highest precedence: the process
+// environment, the suite's env_files, the case's global_env, then the
+// case's own env. It is the environment `${VAR}` expansion and RunBash
+// both resolve against.
+func mergedEnv(item *ScenarioItem, envFileVars map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, kv := range os.Environ() {
+		if idx := strings.Index(kv, "="); idx >= 0 {
+			merged[kv[:idx]] = kv[idx+1:]
+		}
+	}
+	for k, v := range envFileVars {
+		merged[k] = v
+	}
+	for k, v := range item.GlobalEnv {
+		merged[k] = v
+	}
+	for k, v := range item.Env {
+		merged[k] = v
+	}
+	return merged
+}
+
+// expandWithEnv expands ${VAR} references in s against env.
+func expandWithEnv(s string, env map[string]string) string {
+	return os.Expand(s, func(key string) string {
+		return env[key]
+	})
+}
+
+func (t *suitConfig) getConf(filename string, config []byte) *suitConfig {
+	err := unmarshalSuite(filename, config, t)
 
 	if err != nil {
 		// TODO don't use Fatal out of main function
-		log.Fatal(fmt.Sprintf("Cannot recognize configuration structure in %s file: ", config))
+		log.Fatal(fmt.Sprintf("Cannot recognize configuration structure in %s: %s", filename, err))
+	}
+
+	resolveIncludes(t, filename)
+
+	suiteDir := filepath.Dir(filename)
+	envFileVars, err := loadEnvFiles(t.EnvFiles, suiteDir)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	var envs map[string]string
@@ -317,34 +1099,52 @@ func (t *suitConfig) getConf(config []byte) *suitConfig {
 		wdir = workdir
 	}
 
-	for i := 0; i < len((*t).Cases); i++ {
-		if (*t).Cases[i].GlobalEnv != nil {
-			envs = (*t).Cases[i].GlobalEnv
+	for i := range (*t).Cases {
+		item := &(*t).Cases[i]
+
+		if item.GlobalEnv != nil {
+			envs = item.GlobalEnv
 		} else {
-			(*t).Cases[i].GlobalEnv = envs
+			item.GlobalEnv = envs
 		}
 
-		if (*t).Cases[i].Workdir != "" {
-			wdir = (*t).Cases[i].Workdir
+		item.envFileVars = envFileVars
+
+		// Script is left untouched: it already runs with GlobalEnv/Env in its
+		// process environment (see RunBash), so bash's own parameter
+		// expansion handles ${VAR} there. Running it through os.Expand here
+		// would also mangle bash's own special forms ($?, $@, ${VAR:-def},
+		// ${#arr[@]}, ...), which os.Expand doesn't know aren't ours.
+		env := mergedEnv(item, envFileVars)
+		item.Workdir = expandWithEnv(item.Workdir, env)
+		item.SecretPhrase = expandWithEnv(item.SecretPhrase, env)
+
+		if item.Workdir != "" {
+			resolved := item.Workdir
+			if !filepath.IsAbs(resolved) {
+				resolved = filepath.Join(suiteDir, resolved)
+			}
+			wdir = resolved
+			item.Workdir = resolved
 		} else {
-			(*t).Cases[i].Workdir = wdir
+			item.Workdir = wdir
 			if wdir == "" {
 				wdir, _ = os.Getwd()
 			}
 		}
 
-		if (*t).Cases[i].Case != "" {
-			(*t).Cases[i].canShow = true
-			(*t).Cases[i].canRun = true
+		if item.Case != "" {
+			item.canShow = true
+			item.canRun = true
 		}
 
-		if (*t).Cases[i].Name == "" {
-			(*t).Cases[i].canRun = true
+		if item.Name == "" {
+			item.canRun = true
 		}
 
-		if (*t).Cases[i].CanShow() {
-			if (*t).Cases[i].Weight == 0 {
-				(*t).Cases[i].Weight = 1
+		if item.CanShow() {
+			if item.Weight == 0 {
+				item.Weight = 1
 			}
 		}
 	}
@@ -355,6 +1155,85 @@ func duration(start time.Time, finish time.Time) string {
 	return finish.Sub(start).Truncate(time.Millisecond).String()
 }
 
+// configPathsFlag collects repeated -config occurrences into a slice.
+type configPathsFlag []string
+
+func (f *configPathsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *configPathsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func isSuiteFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+// expandConfigPaths turns each -config occurrence into one or more concrete
+// suite file paths, expanding directories (every suite file inside, non
+// recursive) and glob patterns.
+func expandConfigPaths(paths []string) ([]string, error) {
+	result := []string{}
+
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			entries, err := ioutil.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() && isSuiteFile(entry.Name()) {
+					result = append(result, filepath.Join(p, entry.Name()))
+				}
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			result = append(result, p)
+			continue
+		}
+		result = append(result, matches...)
+	}
+
+	return result, nil
+}
+
+// loadConfigs reads and merges one or more external suite files, in order,
+// into a single suitConfig. The suite name is taken from the first file
+// that declares one.
+func loadConfigs(paths []string) (suitConfig, error) {
+	var merged suitConfig
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return suitConfig{}, fmt.Errorf("reading %s: %w", path, err)
+		}
+
+		var part suitConfig
+		part.getConf(path, data)
+
+		if merged.Name == "" {
+			merged.Name = part.Name
+		}
+		merged.Cases = append(merged.Cases, part.Cases...)
+	}
+
+	return merged, nil
+}
+
 func main() {
 	// TODO understand what it is
 	wdir := flag.String("working-directory", "", "Specify a working directory")
@@ -366,6 +1245,17 @@ func main() {
 	// TODO understand what it is
 	v3 := flag.Bool("vvv", false, "Verbosity (mode 3). Show failed and successful outputs")
 
+	n := flag.Int("n", 1, "Number of independent scenarios to run in parallel")
+	format := flag.String("format", "human", "Reporter to use: human, json, junit, tap")
+	runFlag := flag.String("run", "", "Only run cases whose name matches this regex")
+	skipFlag := flag.String("skip", "", "Don't run cases whose name matches this regex")
+
+	benchtimeFlag := flag.String("benchtime", "1s", "Minimum duration to run each benchmark case for")
+	benchcountFlag := flag.Int("benchcount", 0, "Fixed iteration count for benchmark cases (overrides -benchtime)")
+
+	var configPaths configPathsFlag
+	flag.Var(&configPaths, "config", "Path, directory, or glob of a suite file to run instead of the embedded default (repeatable)")
+
 	flag.Parse()
 
 	// Set Log Level
@@ -386,24 +1276,79 @@ func main() {
 	}()
 
 	workdir = *wdir
+	numParallel = *n
 
 	var c suitConfig
 
-	c.getConf(yamlConfig)
+	if len(configPaths) == 0 {
+		c.getConf("case.yaml", yamlConfig)
+	} else {
+		paths, err := expandConfigPaths(configPaths)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	c.printHeader()
+		merged, err := loadConfigs(paths)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c = merged
+	}
+
+	if err := c.validateDependencies(); err != nil {
+		log.Fatal(err)
+	}
+
+	var runPattern, skipPattern *regexp.Regexp
+	var err error
+	if *runFlag != "" {
+		runPattern, err = regexp.Compile(*runFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *skipFlag != "" {
+		skipPattern, err = regexp.Compile(*skipFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	c.applyFilter(flag.Args(), runPattern, skipPattern)
+
+	reporter := newReporter(*format)
+
+	var benchIds, runIds []int
+	for _, id := range c.getScenarioIds() {
+		if c.Cases[id].Benchmark {
+			benchIds = append(benchIds, id)
+		} else {
+			runIds = append(runIds, id)
+		}
+	}
+
+	reporter.OnStart(&c)
 	if c.getScenarioCount() > 0 {
-		print("-----------------------------------------------------------------------------------")
+		c.runScheduled(runIds)
 		i := 1
-		for _, id := range c.getScenarioIds() {
-			c.exec(id)
+		for _, id := range runIds {
 			if c.Cases[id].CanShow() {
-				c.printTestStatus(id, i)
+				reporter.OnCase(&c, id, i)
 				i++
 			}
 		}
-		print("-----------------------------------------------------------------------------------")
 	}
 	c.signOff()
-	c.printSummary()
+	reporter.OnFinish(&c)
+
+	benchtime, err := time.ParseDuration(*benchtimeFlag)
+	if err != nil {
+		benchtime = time.Second
+	}
+	for _, id := range benchIds {
+		if !c.Cases[id].CanShow() {
+			continue
+		}
+		result := runBenchmark(&c.Cases[id], benchtime, *benchcountFlag)
+		reporter.OnBenchmark(&c, id, result)
+	}
 }